@@ -1,6 +1,8 @@
 package bbq
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 )
@@ -11,16 +13,64 @@ type Callback = chan error
 // Flush handles the contents of the batch queue and optionally returns an error
 type Flush = func([]interface{}) error
 
+// OverflowPolicy controls what Enqueue does when the queue is at MaxQueueDepth.
+type OverflowPolicy int
+
+const (
+	// Block makes Enqueue wait until room frees up, either via a flush or another item being
+	// dropped. This is the default policy.
+	Block OverflowPolicy = iota
+	// DropOldest evicts the head of the queue to make room for the new item; the evicted item's
+	// callback receives ErrDropped.
+	DropOldest
+	// DropNewest rejects the incoming item; its callback receives ErrDropped.
+	DropNewest
+	// Error rejects the incoming item and resolves its callback with ErrQueueFull.
+	Error
+)
+
+// ErrDropped is sent to an item's Callback when it is evicted to make room under DropOldest or
+// rejected outright under DropNewest.
+var ErrDropped = errors.New("bbq: item dropped from queue")
+
+// ErrQueueFull is sent to an item's Callback, or returned directly from TryEnqueue, when the queue
+// is at MaxQueueDepth and OverflowPolicy is Error.
+var ErrQueueFull = errors.New("bbq: queue is full")
+
 // BatchQueue is a thread-safe buffer of items that calls a given `flush` function with its contents when reaching a predefined count or time interval, and then empties itself
 type BatchQueue struct {
-	mut           *sync.RWMutex
-	items         []interface{}
-	cbs           []Callback
-	flushTime     time.Duration
-	flushCount    int
-	lastFlushTime time.Time
-	flush         Flush
-	waiting       bool
+	mut            *sync.RWMutex
+	cond           *sync.Cond
+	items          []interface{}
+	cbs            []Callback
+	ctxs           []context.Context
+	flushTime      time.Duration
+	flushCount     int
+	maxQueueDepth  int
+	overflowPolicy OverflowPolicy
+	lastFlushTime  time.Time
+	flush          Flush
+	waiting        bool
+	sem            chan struct{}
+	wg             *sync.WaitGroup
+	seqs           []uint64
+	storage        Storage
+	marshal        func(interface{}) ([]byte, error)
+	unmarshal      func([]byte) (interface{}, error)
+	flushBytes     int
+	sizer          func(interface{}) int
+	byteTotal      int
+	itemBytes      []int
+	attempts       []int
+	errorHandler   ErrorHandler
+	maxAttempts    int
+	deadLetter     Flush
+	metrics        Metrics
+	onFlush        func(FlushStats)
+	ackMut         sync.Mutex
+	ackLedger      []uint64
+	ackedSeqs      map[uint64]bool
+	done           []chan struct{}
 }
 
 // BatchQueueOptions define the behavior of the batch queue
@@ -30,12 +80,72 @@ type BatchQueueOptions struct {
 
 	// FlushCount is the number of items that can accumulate within FlushTime before being flushed immediately. Set this to 0 will flush on every Enqueue().
 	FlushCount int
+
+	// MaxQueueDepth caps the number of pending items the queue will hold at once. 0 means unbounded.
+	MaxQueueDepth int
+
+	// OverflowPolicy controls what happens when Enqueue is called while the queue is at
+	// MaxQueueDepth. Defaults to Block.
+	OverflowPolicy OverflowPolicy
+
+	// MaxConcurrentFlushes bounds how many flushes may run at once. When a flush is triggered, the
+	// current batch is handed off to a worker so Enqueue can keep accumulating the next batch
+	// instead of waiting on a slow downstream. Defaults to 1, which still runs flushes off the
+	// caller's goroutine but never overlaps them.
+	MaxConcurrentFlushes int
+
+	// Storage, if set, persists each item before its Callback resolves so pending items survive a
+	// restart. NewBatchQueue replays any unacked entries into the queue at startup, which panics if
+	// Storage.LoadPending returns an error; there's no pending queue yet for that error to resolve
+	// onto, so callers that need to handle a transient read failure gracefully should retry
+	// constructing the queue themselves rather than relying on NewBatchQueue to recover. Marshal and
+	// Unmarshal must both be set when Storage is set, or NewBatchQueue panics.
+	Storage Storage
+
+	// Marshal converts an enqueued item to bytes for Storage. Required when Storage is set.
+	Marshal func(interface{}) ([]byte, error)
+
+	// Unmarshal converts bytes read back from Storage into an item. Required when Storage is set.
+	Unmarshal func([]byte) (interface{}, error)
+
+	// FlushBytes, if set alongside Sizer, triggers a flush once the accumulated size of the
+	// pending batch reaches it, in addition to FlushTime and FlushCount. An item that would push a
+	// non-empty batch past FlushBytes causes that batch to be flushed first and starts the next one.
+	FlushBytes int
+
+	// Sizer reports the size of an item for FlushBytes accounting. Required when FlushBytes is set.
+	Sizer func(interface{}) int
+
+	// ErrorHandler, if set, is given a flush error and the items that failed, and classifies them
+	// into items to retry and items to drop. Without it, every callback in a failed batch simply
+	// receives the flush error.
+	ErrorHandler ErrorHandler
+
+	// MaxAttempts caps how many times an item classified for retry may be re-flushed before it is
+	// dropped instead. 0 means unlimited.
+	MaxAttempts int
+
+	// DeadLetter, if set, is called with items the ErrorHandler classified for dropping, and with
+	// retried items that have hit MaxAttempts, as a side channel before their callbacks resolve with
+	// the original flush error.
+	DeadLetter Flush
+
+	// Metrics receives counters about the queue's runtime behavior. If unset and MetricsName is
+	// set, an ExpvarMetrics is created under that name. If both are unset, metrics are a no-op.
+	Metrics Metrics
+
+	// MetricsName names the expvar.Map to publish default metrics under. Ignored if Metrics is set.
+	MetricsName string
+
+	// OnFlush, if set, is called after every flush attempt with stats about what happened.
+	OnFlush func(FlushStats)
 }
 
 // DefaultOptions will flush at least once per second, including whenever the queue reaches 1024 items
-var DefaultOptions = BatchQueueOptions{time.Second, 1024}
+var DefaultOptions = BatchQueueOptions{FlushTime: time.Second, FlushCount: 1024}
 
-// NewBatchQueue returns a queue
+// NewBatchQueue returns a queue. If opts.Storage is set, it panics on a misconfigured
+// Marshal/Unmarshal or on a failed Storage.LoadPending call; see BatchQueueOptions.Storage.
 func NewBatchQueue(flush Flush, opts BatchQueueOptions) *BatchQueue {
 	if opts.FlushTime == 0 {
 		opts.FlushTime = DefaultOptions.FlushTime
@@ -43,29 +153,183 @@ func NewBatchQueue(flush Flush, opts BatchQueueOptions) *BatchQueue {
 	if opts.FlushCount == 0 {
 		opts.FlushCount = DefaultOptions.FlushCount
 	}
+	if opts.MaxConcurrentFlushes == 0 {
+		opts.MaxConcurrentFlushes = 1
+	}
+	metrics := opts.Metrics
+	if metrics == nil {
+		if opts.MetricsName != "" {
+			metrics = NewExpvarMetrics(opts.MetricsName)
+		} else {
+			metrics = noopMetrics{}
+		}
+	}
 	mut := &sync.RWMutex{}
 	items := []interface{}{}
 	cbs := []Callback{}
-	return &BatchQueue{mut, items, cbs, opts.FlushTime, opts.FlushCount, time.Now(), flush, false}
+	ctxs := []context.Context{}
+	q := &BatchQueue{
+		mut:            mut,
+		items:          items,
+		cbs:            cbs,
+		ctxs:           ctxs,
+		flushTime:      opts.FlushTime,
+		flushCount:     opts.FlushCount,
+		maxQueueDepth:  opts.MaxQueueDepth,
+		overflowPolicy: opts.OverflowPolicy,
+		lastFlushTime:  time.Now(),
+		flush:          flush,
+		waiting:        false,
+		sem:            make(chan struct{}, opts.MaxConcurrentFlushes),
+		wg:             &sync.WaitGroup{},
+		flushBytes:     opts.FlushBytes,
+		sizer:          opts.Sizer,
+		errorHandler:   opts.ErrorHandler,
+		maxAttempts:    opts.MaxAttempts,
+		deadLetter:     opts.DeadLetter,
+		metrics:        metrics,
+		onFlush:        opts.OnFlush,
+	}
+	q.cond = sync.NewCond(mut)
+	q.wireStorage(opts)
+	return q
 }
 
 // Enqueue puts an item on the batch queue
 func (q *BatchQueue) Enqueue(item interface{}) Callback {
-	q.mut.Lock()
+	cb, _ := q.enqueue(context.Background(), item, false)
+	return cb
+}
+
+// EnqueueCtx puts an item on the batch queue with an attached context. If ctx is canceled or its
+// deadline is exceeded before the item is flushed, the item is removed from the pending batch and
+// its callback receives ctx.Err() instead of waiting on a flush that can no longer help the caller.
+func (q *BatchQueue) EnqueueCtx(ctx context.Context, item interface{}) Callback {
+	cb, _ := q.enqueue(ctx, item, false)
+	return cb
+}
+
+// TryEnqueue behaves like Enqueue, but never waits for room in the queue: if MaxQueueDepth is reached and
+// OverflowPolicy is Block or Error, it returns immediately with a nil Callback and an error
+// instead of waiting for room to free up.
+func (q *BatchQueue) TryEnqueue(item interface{}) (Callback, error) {
+	return q.enqueue(context.Background(), item, true)
+}
+
+func (q *BatchQueue) enqueue(ctx context.Context, item interface{}, noWait bool) (Callback, error) {
 	cb := make(chan error, 1)
+
+	if err := ctx.Err(); err != nil {
+		cb <- err
+		close(cb)
+		return cb, nil
+	}
+
+	q.mut.Lock()
+
+	if q.full() && q.overflowPolicy == Block {
+		if noWait {
+			q.mut.Unlock()
+			return nil, ErrQueueFull
+		}
+		q.waitForRoom(ctx)
+		if err := ctx.Err(); err != nil {
+			q.mut.Unlock()
+			cb <- err
+			close(cb)
+			return cb, nil
+		}
+	}
+
+	if q.full() {
+		switch q.overflowPolicy {
+		case DropOldest:
+			dropped := q.cbs[0]
+			if q.done[0] != nil {
+				close(q.done[0])
+			}
+			q.ack(q.seqs[:1])
+			q.byteTotal -= q.itemBytes[0]
+			q.items = q.items[1:]
+			q.cbs = q.cbs[1:]
+			q.ctxs = q.ctxs[1:]
+			q.seqs = q.seqs[1:]
+			q.itemBytes = q.itemBytes[1:]
+			q.attempts = q.attempts[1:]
+			q.done = q.done[1:]
+			dropped <- ErrDropped
+			close(dropped)
+		case Error:
+			q.mut.Unlock()
+			if noWait {
+				close(cb)
+				return nil, ErrQueueFull
+			}
+			cb <- ErrQueueFull
+			close(cb)
+			return cb, nil
+		default: // DropNewest
+			q.mut.Unlock()
+			cb <- ErrDropped
+			close(cb)
+			return cb, nil
+		}
+	}
+
+	var itemBytes int
+	if q.flushBytes > 0 && q.sizer != nil {
+		itemBytes = q.sizer(item)
+		if len(q.items) > 0 && q.byteTotal+itemBytes > q.flushBytes {
+			q.mut.Unlock()
+			q.flushWithTrigger(TriggerCount)
+			q.mut.Lock()
+		}
+	}
+
+	seq, err := q.persist(item)
+	if err != nil {
+		q.mut.Unlock()
+		cb <- err
+		close(cb)
+		return cb, nil
+	}
+
+	var itemDone chan struct{}
+	if ctx.Done() != nil {
+		itemDone = make(chan struct{})
+	}
+
 	q.items = append(q.items, item)
 	q.cbs = append(q.cbs, cb)
+	q.ctxs = append(q.ctxs, ctx)
+	q.seqs = append(q.seqs, seq)
+	q.itemBytes = append(q.itemBytes, itemBytes)
+	q.attempts = append(q.attempts, 0)
+	q.done = append(q.done, itemDone)
+	q.byteTotal += itemBytes
+	q.metrics.IncEnqueued(1)
+	q.metrics.SetQueueDepth(len(q.items))
+
+	if itemDone != nil {
+		go q.watchCtx(ctx, cb, itemDone)
+	}
 
 	if len(q.items) >= q.flushCount {
 		q.mut.Unlock()
-		q.FlushNow()
-		return cb
+		q.flushWithTrigger(TriggerCount)
+		return cb, nil
+	}
+
+	if q.flushBytes > 0 && q.sizer != nil && q.byteTotal >= q.flushBytes {
+		q.mut.Unlock()
+		q.flushWithTrigger(TriggerCount)
+		return cb, nil
 	}
 
 	if time.Now().After(q.lastFlushTime.Add(q.flushTime)) {
 		q.mut.Unlock()
-		q.FlushNow()
-		return cb
+		q.flushWithTrigger(TriggerTime)
+		return cb, nil
 	}
 
 	if !q.waiting {
@@ -75,32 +339,183 @@ func (q *BatchQueue) Enqueue(item interface{}) Callback {
 
 	q.mut.Unlock() // not using defer because we need to unlock before flushing
 
-	return cb
+	return cb, nil
+}
+
+// full reports whether the queue is at MaxQueueDepth. Callers must hold q.mut.
+func (q *BatchQueue) full() bool {
+	return q.maxQueueDepth > 0 && len(q.items) >= q.maxQueueDepth
 }
 
-// FlushNow will immediately flush the batch queue
+// waitForRoom blocks until the queue has room or ctx is done, waking whenever a flush or a drop
+// makes space. Callers must hold q.mut, which is released while waiting and re-acquired on return.
+func (q *BatchQueue) waitForRoom(ctx context.Context) {
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				q.cond.Broadcast()
+			case <-stop:
+			}
+		}()
+	}
+
+	for q.full() && ctx.Err() == nil {
+		q.cond.Wait()
+	}
+}
+
+// watchCtx waits for ctx to be canceled and, if the item behind cb is still pending, pulls it out
+// of the batch and resolves cb with ctx.Err() so the caller isn't left blocking on a flush it can
+// no longer use. done is closed as soon as the item leaves the queue some other way (flushed,
+// dropped, or dead-lettered), so watchCtx can exit immediately instead of leaking until ctx is
+// eventually canceled.
+func (q *BatchQueue) watchCtx(ctx context.Context, cb Callback, done chan struct{}) {
+	select {
+	case <-ctx.Done():
+	case <-done:
+		return
+	}
+
+	q.mut.Lock()
+	for i, c := range q.cbs {
+		if c == cb {
+			q.ack(q.seqs[i : i+1])
+			q.byteTotal -= q.itemBytes[i]
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.cbs = append(q.cbs[:i], q.cbs[i+1:]...)
+			q.ctxs = append(q.ctxs[:i], q.ctxs[i+1:]...)
+			q.seqs = append(q.seqs[:i], q.seqs[i+1:]...)
+			q.itemBytes = append(q.itemBytes[:i], q.itemBytes[i+1:]...)
+			q.attempts = append(q.attempts[:i], q.attempts[i+1:]...)
+			q.done = append(q.done[:i], q.done[i+1:]...)
+			q.metrics.SetQueueDepth(len(q.items))
+			q.mut.Unlock()
+			q.cond.Broadcast()
+			cb <- ctx.Err()
+			close(cb)
+			return
+		}
+	}
+	q.mut.Unlock()
+}
+
+// FlushNow seals the current batch and hands it off to a flush worker, then returns without
+// waiting for the worker to finish. This lets Enqueue keep accumulating the next batch instead of
+// blocking behind a slow flush. At most MaxConcurrentFlushes workers run at once; callers that need
+// to wait for outstanding flushes to finish (e.g. before shutdown) should follow up with Drain.
 func (q *BatchQueue) FlushNow() {
+	q.flushWithTrigger(TriggerManual)
+}
+
+// flushWithTrigger is FlushNow's implementation, parameterized by what caused the flush so it can
+// be reported to Metrics and OnFlush.
+func (q *BatchQueue) flushWithTrigger(trigger FlushTrigger) {
 	q.mut.Lock()
-	defer q.mut.Unlock()
-	tmp := make([]interface{}, len(q.items))
-	copy(tmp, q.items)
+	if len(q.items) == 0 {
+		q.mut.Unlock()
+		return
+	}
+
+	items := make([]interface{}, len(q.items))
+	copy(items, q.items)
+	cbs := q.cbs
+	ctxs := q.ctxs
+	seqs := q.seqs
+	sizes := q.itemBytes
+	attempts := q.attempts
+	dones := q.done
+
 	q.items = []interface{}{}
+	q.cbs = []Callback{}
+	q.ctxs = []context.Context{}
+	q.seqs = []uint64{}
+	q.itemBytes = []int{}
+	q.attempts = []int{}
+	q.done = []chan struct{}{}
+	q.byteTotal = 0
+	q.lastFlushTime = time.Now()
+	q.waiting = false
+	q.metrics.SetQueueDepth(0)
+	q.cond.Broadcast()
+	q.mut.Unlock()
 
-	if err := q.flush(tmp); err != nil {
-		for _, cb := range q.cbs {
-			cb <- err
+	q.sem <- struct{}{}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		defer func() { <-q.sem }()
+		q.runFlush(items, cbs, ctxs, seqs, sizes, attempts, dones, trigger)
+	}()
+}
+
+// runFlush calls the user's Flush function and fans the result out to the batch's callbacks. On
+// success, it acks the batch's entries in Storage, if one is configured. On failure, it sends the
+// error to every callback, or, if ErrorHandler is set, defers to handleFlushError. Either way, it
+// reports the outcome to Metrics and OnFlush.
+func (q *BatchQueue) runFlush(items []interface{}, cbs []Callback, ctxs []context.Context, seqs []uint64, sizes []int, attempts []int, dones []chan struct{}, trigger FlushTrigger) {
+	start := time.Now()
+	err := q.flush(items)
+	duration := time.Since(start)
+
+	q.metrics.IncFlushCount()
+	q.metrics.ObserveFlushLatency(duration)
+	if q.onFlush != nil {
+		q.onFlush(FlushStats{ItemCount: len(items), Duration: duration, Err: err, Trigger: trigger})
+	}
+
+	if err == nil {
+		q.metrics.IncFlushed(len(items))
+		q.ack(seqs)
+		for i, cb := range cbs {
 			close(cb)
+			if dones[i] != nil {
+				close(dones[i])
+			}
 		}
-	} else {
-		for _, cb := range q.cbs {
+		return
+	}
+
+	q.metrics.IncFlushErrors()
+
+	if q.errorHandler == nil {
+		for i, cb := range cbs {
+			cb <- err
 			close(cb)
+			if dones[i] != nil {
+				close(dones[i])
+			}
 		}
+		return
 	}
 
-	q.cbs = []Callback{}
+	q.handleFlushError(err, items, cbs, ctxs, seqs, sizes, attempts, dones)
+}
 
-	q.lastFlushTime = time.Now()
-	q.waiting = false
+// Drain waits for all outstanding flush workers to finish, up to ctx's deadline.
+func (q *BatchQueue) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close flushes any remaining items and waits for all outstanding flush workers to finish, up to
+// ctx's deadline. This lets callers bound how long a shutdown path waits on a slow downstream
+// before giving up.
+func (q *BatchQueue) Close(ctx context.Context) error {
+	q.flushWithTrigger(TriggerShutdown)
+	return q.Drain(ctx)
 }
 
 func (q *BatchQueue) setFlushTimeout() {
@@ -109,7 +524,8 @@ func (q *BatchQueue) setFlushTimeout() {
 		q.mut.RLock()
 		if q.waiting {
 			q.mut.RUnlock()
-			q.FlushNow()
+			q.metrics.IncTimeoutFlushes()
+			q.flushWithTrigger(TriggerTime)
 		} else {
 			q.mut.RUnlock()
 		}
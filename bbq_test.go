@@ -1,8 +1,12 @@
 package bbq
 
 import (
+	"context"
 	"errors"
+	"expvar"
 	"fmt"
+	"runtime"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -18,9 +22,10 @@ func Example() {
 		fmt.Println(str)
 		return nil
 	}
-	q := NewBatchQueue(flush, BatchQueueOptions{time.Second, 2})
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 2})
 	q.Enqueue("hello")
 	q.Enqueue("world")
+	q.Drain(context.Background())
 	// Output:
 	// hello world (12)
 }
@@ -32,9 +37,10 @@ func Example_time() {
 		}
 		return nil
 	}
-	q := NewBatchQueue(flush, BatchQueueOptions{1 * time.Millisecond, 2})
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: 1 * time.Millisecond, FlushCount: 2})
 	q.Enqueue("🍪")
 	time.Sleep(2 * time.Millisecond)
+	q.Drain(context.Background())
 	// Output:
 	// 🍪
 }
@@ -46,9 +52,10 @@ func Example_now() {
 		}
 		return nil
 	}
-	q := NewBatchQueue(flush, BatchQueueOptions{time.Second, 2})
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 2})
 	q.Enqueue("🥑")
 	q.FlushNow()
+	q.Drain(context.Background())
 	// Output:
 	// 🥑
 }
@@ -66,12 +73,13 @@ func TestRoundtrip(t *testing.T) {
 		return nil
 	}
 
-	q := NewBatchQueue(flush, BatchQueueOptions{3 * time.Second, 3})
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: 3 * time.Second, FlushCount: 3})
 	k1 := "k1"
 	k2 := "k2"
 	q.Enqueue(TestItem{k1})
 	q.Enqueue(TestItem{k2})
 	q.FlushNow()
+	q.Drain(context.Background())
 	actual := out.key
 	if actual != k2 {
 		t.Errorf("Should be able to roundtrip key, got %v", actual)
@@ -92,7 +100,7 @@ func TestFlushOnTime(t *testing.T) {
 		}
 		return nil
 	}
-	q := NewBatchQueue(flush, BatchQueueOptions{1 * time.Millisecond, 3})
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: 1 * time.Millisecond, FlushCount: 3})
 	k1 := "k1"
 	k2 := "k2"
 	q.Enqueue(TestItem{k1})
@@ -119,10 +127,11 @@ func TestFlushOnCount(t *testing.T) {
 		return nil
 	}
 
-	q := NewBatchQueue(flush, BatchQueueOptions{time.Second, 1})
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 1})
 	k1 := "k1"
 
-	q.Enqueue(TestItem{k1})
+	cb := q.Enqueue(TestItem{k1})
+	<-cb
 	actual := out.key
 	if actual != k1 {
 		t.Errorf("Should be able to flush key, got %v", actual)
@@ -133,7 +142,7 @@ func TestErrCallback(t *testing.T) {
 	flush := func(ms []interface{}) error {
 		return errors.New("test")
 	}
-	q := NewBatchQueue(flush, BatchQueueOptions{1 * time.Millisecond, 3})
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: 1 * time.Millisecond, FlushCount: 3})
 	k1 := "k1"
 
 	cb := q.Enqueue(TestItem{k1})
@@ -142,13 +151,476 @@ func TestErrCallback(t *testing.T) {
 	}
 }
 
+func TestEnqueueCtxCanceled(t *testing.T) {
+	flush := func(ms []interface{}) error {
+		t.Errorf("Should not flush canceled item, got %v", ms)
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 3})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cb := q.EnqueueCtx(ctx, TestItem{"k1"})
+	cancel()
+
+	if err := <-cb; err != ctx.Err() {
+		t.Errorf("Should get callback with ctx.Err(), got %v", err)
+	}
+}
+
+func TestWatchCtxExitsOnFlush(t *testing.T) {
+	flush := func(ms []interface{}) error {
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 1})
+
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i := 0; i < 50; i++ {
+		<-q.EnqueueCtx(ctx, TestItem{"k1"})
+	}
+
+	var after int
+	for i := 0; i < 100; i++ {
+		after = runtime.NumGoroutine()
+		if after <= before+5 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if after > before+5 {
+		t.Errorf("watchCtx goroutines should exit once their item flushes, got %d goroutines (started at %d)", after, before)
+	}
+}
+
+func TestClose(t *testing.T) {
+	flushed := false
+	flush := func(ms []interface{}) error {
+		flushed = true
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 3})
+	q.Enqueue(TestItem{"k1"})
+
+	if err := q.Close(context.Background()); err != nil {
+		t.Errorf("Should close without error, got %v", err)
+	}
+	if !flushed {
+		t.Errorf("Should flush remaining items on Close")
+	}
+}
+
+func TestTryEnqueueErrorPolicy(t *testing.T) {
+	flush := func(ms []interface{}) error {
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 3, MaxQueueDepth: 1, OverflowPolicy: Error})
+	q.Enqueue(TestItem{"k1"})
+
+	cb, err := q.TryEnqueue(TestItem{"k2"})
+	if err != ErrQueueFull {
+		t.Errorf("Should get ErrQueueFull, got %v", err)
+	}
+	if cb != nil {
+		t.Errorf("Should get nil Callback when rejected, got %v", cb)
+	}
+}
+
+func TestEnqueueDropOldest(t *testing.T) {
+	flush := func(ms []interface{}) error {
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 3, MaxQueueDepth: 1, OverflowPolicy: DropOldest})
+
+	cb1 := q.Enqueue(TestItem{"k1"})
+	q.Enqueue(TestItem{"k2"})
+
+	if err := <-cb1; err != ErrDropped {
+		t.Errorf("Should get ErrDropped for evicted item, got %v", err)
+	}
+}
+
+func TestEnqueueDropNewest(t *testing.T) {
+	flush := func(ms []interface{}) error {
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 3, MaxQueueDepth: 1, OverflowPolicy: DropNewest})
+
+	q.Enqueue(TestItem{"k1"})
+	cb2 := q.Enqueue(TestItem{"k2"})
+
+	if err := <-cb2; err != ErrDropped {
+		t.Errorf("Should get ErrDropped for rejected item, got %v", err)
+	}
+}
+
+func TestDrainWaitsForOutstandingFlushes(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	flush := func(ms []interface{}) error {
+		close(started)
+		<-release
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 1})
+	q.Enqueue(TestItem{"k1"})
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		if err := q.Drain(context.Background()); err != nil {
+			t.Errorf("Should drain without error, got %v", err)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Errorf("Drain should wait for the in-flight flush to finish")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	<-done
+}
+
+type memStorage struct {
+	mut     sync.Mutex
+	nextSeq uint64
+	pending map[uint64][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{nextSeq: 1, pending: map[uint64][]byte{}}
+}
+
+func (s *memStorage) Append(data []byte) (uint64, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	seq := s.nextSeq
+	s.nextSeq++
+	s.pending[seq] = data
+	return seq, nil
+}
+
+func (s *memStorage) LoadPending() ([]Entry, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	entries := make([]Entry, 0, len(s.pending))
+	for seq, data := range s.pending {
+		entries = append(entries, Entry{Seq: seq, Data: data})
+	}
+	return entries, nil
+}
+
+func (s *memStorage) Ack(seq uint64) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for existing := range s.pending {
+		if existing <= seq {
+			delete(s.pending, existing)
+		}
+	}
+	return nil
+}
+
+func marshalTestItem(item interface{}) ([]byte, error) {
+	return []byte(item.(TestItem).key), nil
+}
+
+func unmarshalTestItem(data []byte) (interface{}, error) {
+	return TestItem{string(data)}, nil
+}
+
+func TestStoragePersistsAndAcks(t *testing.T) {
+	storage := newMemStorage()
+	flush := func(ms []interface{}) error {
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:  time.Second,
+		FlushCount: 1,
+		Storage:    storage,
+		Marshal:    marshalTestItem,
+		Unmarshal:  unmarshalTestItem,
+	})
+
+	cb := q.Enqueue(TestItem{"k1"})
+	<-cb
+
+	pending, err := storage.LoadPending()
+	if err != nil {
+		t.Fatalf("LoadPending failed: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Should ack entry after successful flush, got %v pending", pending)
+	}
+}
+
+func TestStorageReplaysPendingEntries(t *testing.T) {
+	storage := newMemStorage()
+	storage.Append([]byte("k1"))
+
+	var flushed []interface{}
+	flush := func(ms []interface{}) error {
+		flushed = ms
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:  time.Second,
+		FlushCount: 3,
+		Storage:    storage,
+		Marshal:    marshalTestItem,
+		Unmarshal:  unmarshalTestItem,
+	})
+	q.FlushNow()
+	q.Drain(context.Background())
+
+	if len(flushed) != 1 || flushed[0].(TestItem).key != "k1" {
+		t.Errorf("Should replay pending entry into the queue, got %v", flushed)
+	}
+}
+
+func TestStorageReplayedEntryCanBeRetried(t *testing.T) {
+	storage := newMemStorage()
+	storage.Append([]byte("k1"))
+
+	attempt := 0
+	flush := func(ms []interface{}) error {
+		attempt++
+		if attempt == 1 {
+			return errors.New("transient")
+		}
+		return nil
+	}
+	handler := func(err error, failed []interface{}) ([]interface{}, []interface{}) {
+		return failed, nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:    time.Second,
+		FlushCount:   1,
+		Storage:      storage,
+		Marshal:      marshalTestItem,
+		Unmarshal:    unmarshalTestItem,
+		ErrorHandler: handler,
+	})
+	q.FlushNow()
+	q.Drain(context.Background())
+	q.FlushNow()
+	q.Drain(context.Background())
+
+	if attempt != 2 {
+		t.Errorf("Should have retried the replayed entry once, got %d attempts", attempt)
+	}
+}
+
+func TestStorageAckKeepsRetriedLowerSeqDurable(t *testing.T) {
+	storage := newMemStorage()
+	flush := func(ms []interface{}) error {
+		return errors.New("permanent")
+	}
+	handler := func(err error, failed []interface{}) ([]interface{}, []interface{}) {
+		var retry, drop []interface{}
+		for _, item := range failed {
+			if item.(TestItem).key == "a" {
+				retry = append(retry, item)
+			} else {
+				drop = append(drop, item)
+			}
+		}
+		return retry, drop
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:    time.Second,
+		FlushCount:   2,
+		Storage:      storage,
+		Marshal:      marshalTestItem,
+		Unmarshal:    unmarshalTestItem,
+		ErrorHandler: handler,
+	})
+
+	q.Enqueue(TestItem{"a"})
+	cbB := q.Enqueue(TestItem{"b"})
+	<-cbB
+
+	pending, err := storage.LoadPending()
+	if err != nil {
+		t.Fatalf("LoadPending failed: %v", err)
+	}
+	for _, entry := range pending {
+		if string(entry.Data) == "a" {
+			return
+		}
+	}
+	t.Errorf("Retried lower-seq item should stay durable in Storage even though a higher seq was acked, got %v", pending)
+}
+
+// reverseOrderStorage wraps memStorage but returns LoadPending results in descending seq order,
+// breaking the append-order contract, to exercise the sort wireStorage applies before replaying.
+type reverseOrderStorage struct {
+	*memStorage
+}
+
+func (s *reverseOrderStorage) LoadPending() ([]Entry, error) {
+	entries, err := s.memStorage.LoadPending()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq > entries[j].Seq })
+	return entries, nil
+}
+
+func TestStorageReplayOutOfOrderLoadPendingStillAcksAll(t *testing.T) {
+	storage := &reverseOrderStorage{memStorage: newMemStorage()}
+	storage.Append([]byte("a"))
+	storage.Append([]byte("b"))
+	storage.Append([]byte("c"))
+
+	var flushed []interface{}
+	flush := func(ms []interface{}) error {
+		flushed = append(flushed, ms...)
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:  time.Second,
+		FlushCount: 3,
+		Storage:    storage,
+		Marshal:    marshalTestItem,
+		Unmarshal:  unmarshalTestItem,
+	})
+	q.FlushNow()
+	q.Drain(context.Background())
+
+	if len(flushed) != 3 {
+		t.Fatalf("Should replay and flush all 3 entries, got %v", flushed)
+	}
+
+	pending, err := storage.LoadPending()
+	if err != nil {
+		t.Fatalf("LoadPending failed: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Should ack every replayed entry regardless of LoadPending's order, got %v pending", pending)
+	}
+}
+
+func TestFlushOnBytes(t *testing.T) {
+	var flushed [][]interface{}
+	flush := func(ms []interface{}) error {
+		flushed = append(flushed, ms)
+		return nil
+	}
+	sizer := func(item interface{}) int {
+		return len(item.(TestItem).key)
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:  time.Second,
+		FlushCount: 10,
+		FlushBytes: 4,
+		Sizer:      sizer,
+	})
+
+	cb1 := q.Enqueue(TestItem{"ab"})
+	cb2 := q.Enqueue(TestItem{"cd"})
+	<-cb1
+	<-cb2
+
+	if len(flushed) != 1 || len(flushed[0]) != 2 {
+		t.Errorf("Should flush once 4 bytes have accumulated, got %v", flushed)
+	}
+}
+
+func TestErrorHandlerRetry(t *testing.T) {
+	attempt := 0
+	flush := func(ms []interface{}) error {
+		attempt++
+		if attempt == 1 {
+			return errors.New("transient")
+		}
+		return nil
+	}
+	handler := func(err error, failed []interface{}) ([]interface{}, []interface{}) {
+		return failed, nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:    10 * time.Millisecond,
+		FlushCount:   3,
+		ErrorHandler: handler,
+	})
+
+	cb := q.Enqueue(TestItem{"k1"})
+	if err := <-cb; err != nil {
+		t.Errorf("Should eventually succeed after retry, got %v", err)
+	}
+	if attempt != 2 {
+		t.Errorf("Should have retried once, got %d attempts", attempt)
+	}
+}
+
+func TestErrorHandlerDeadLetter(t *testing.T) {
+	var deadLettered []interface{}
+	flush := func(ms []interface{}) error {
+		return errors.New("permanent")
+	}
+	deadLetter := func(ms []interface{}) error {
+		deadLettered = ms
+		return nil
+	}
+	handler := func(err error, failed []interface{}) ([]interface{}, []interface{}) {
+		return nil, failed
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:    time.Second,
+		FlushCount:   1,
+		ErrorHandler: handler,
+		DeadLetter:   deadLetter,
+	})
+
+	cb := q.Enqueue(TestItem{"k1"})
+	if err := <-cb; err == nil {
+		t.Errorf("Should get the flush error, got nil")
+	}
+	if len(deadLettered) != 1 || deadLettered[0].(TestItem).key != "k1" {
+		t.Errorf("Should route dropped item to DeadLetter, got %v", deadLettered)
+	}
+}
+
+func TestErrorHandlerUncomparableItem(t *testing.T) {
+	var deadLettered []interface{}
+	flush := func(ms []interface{}) error {
+		return errors.New("permanent")
+	}
+	deadLetter := func(ms []interface{}) error {
+		deadLettered = ms
+		return nil
+	}
+	handler := func(err error, failed []interface{}) ([]interface{}, []interface{}) {
+		return nil, failed
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:    time.Second,
+		FlushCount:   1,
+		ErrorHandler: handler,
+		DeadLetter:   deadLetter,
+	})
+
+	cb := q.Enqueue(map[string]int{"a": 1})
+	if err := <-cb; err == nil {
+		t.Errorf("Should get the flush error, got nil")
+	}
+	if len(deadLettered) != 1 {
+		t.Errorf("Should route the uncomparable item to DeadLetter without panicking, got %v", deadLettered)
+	}
+}
+
 func TestFlushTimeout(t *testing.T) {
 	flushes := 0
 	flush := func(ms []interface{}) error {
 		flushes += 1
 		return nil
 	}
-	q := NewBatchQueue(flush, BatchQueueOptions{10 * time.Millisecond, 3})
+	q := NewBatchQueue(flush, BatchQueueOptions{FlushTime: 10 * time.Millisecond, FlushCount: 3})
 
 	cb1 := q.Enqueue(TestItem{"k1"}) // sets flush timeout for 10ms
 	q.FlushNow()                     // should clear timeout
@@ -162,3 +634,54 @@ func TestFlushTimeout(t *testing.T) {
 		t.Errorf("Expected 1 flush, got %v", flushes)
 	}
 }
+
+func TestOnFlushReportsStats(t *testing.T) {
+	flush := func(ms []interface{}) error {
+		return errors.New("boom")
+	}
+	var stats FlushStats
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:  time.Second,
+		FlushCount: 2,
+		OnFlush: func(s FlushStats) {
+			stats = s
+		},
+	})
+
+	cb1 := q.Enqueue(TestItem{"k1"})
+	cb2 := q.Enqueue(TestItem{"k2"})
+	<-cb1
+	<-cb2
+
+	if stats.ItemCount != 2 {
+		t.Errorf("Expected ItemCount 2, got %v", stats.ItemCount)
+	}
+	if stats.Trigger != TriggerCount {
+		t.Errorf("Expected TriggerCount, got %v", stats.Trigger)
+	}
+	if stats.Err == nil {
+		t.Errorf("Expected flush error to be reported, got nil")
+	}
+}
+
+func TestMetricsNameRegistersExpvar(t *testing.T) {
+	flush := func(ms []interface{}) error {
+		return nil
+	}
+	q := NewBatchQueue(flush, BatchQueueOptions{
+		FlushTime:   time.Second,
+		FlushCount:  1,
+		MetricsName: "bbq_test_metrics",
+	})
+
+	cb := q.Enqueue(TestItem{"k1"})
+	<-cb
+
+	m, ok := expvar.Get("bbq_test_metrics").(*expvar.Map)
+	if !ok {
+		t.Fatalf("Expected an expvar.Map registered under bbq_test_metrics")
+	}
+	if v := m.Get("flushed"); v == nil || v.String() != "1" {
+		t.Errorf("Expected flushed=1, got %v", v)
+	}
+}
@@ -0,0 +1,145 @@
+package bbq
+
+import (
+	"context"
+	"reflect"
+)
+
+// ErrorHandler lets callers react to a flush failure beyond simply fanning the error out to every
+// callback. It receives the flush error and the items that failed, and classifies them into items
+// to retry (re-enqueued at the head of the buffer) and items to drop (routed to DeadLetter, if
+// set, then resolved with err). Items the handler mentions in neither slice are resolved with err,
+// same as if no ErrorHandler were set.
+type ErrorHandler func(err error, failed []interface{}) (retry []interface{}, drop []interface{})
+
+// handleFlushError classifies a failed batch via q.errorHandler and acts on its verdict: items to
+// retry are re-enqueued at the head of the buffer (dropped instead if they have hit MaxAttempts),
+// items to drop are routed through DeadLetter and resolved with err, and anything the handler
+// didn't mention is resolved with err directly.
+func (q *BatchQueue) handleFlushError(err error, items []interface{}, cbs []Callback, ctxs []context.Context, seqs []uint64, sizes []int, attempts []int, dones []chan struct{}) {
+	retry, drop := q.errorHandler(err, items)
+	retrySet := newItemSet(retry)
+	dropSet := newItemSet(drop)
+
+	var toRetry []retryEntry
+	var toDrop []int
+
+	for i, item := range items {
+		retried := retrySet.take(item)
+		switch {
+		case retried && (q.maxAttempts == 0 || attempts[i]+1 <= q.maxAttempts):
+			toRetry = append(toRetry, retryEntry{item, cbs[i], ctxs[i], seqs[i], sizes[i], attempts[i] + 1, dones[i]})
+		case retried || dropSet.take(item):
+			toDrop = append(toDrop, i)
+		default:
+			q.ack(seqs[i : i+1])
+			cbs[i] <- err
+			close(cbs[i])
+			if dones[i] != nil {
+				close(dones[i])
+			}
+		}
+	}
+
+	if len(toDrop) > 0 {
+		q.sendToDeadLetter(toDrop, items, cbs, seqs, dones, err)
+	}
+
+	if len(toRetry) > 0 {
+		q.requeue(toRetry)
+	}
+}
+
+type retryEntry struct {
+	item     interface{}
+	cb       Callback
+	ctx      context.Context
+	seq      uint64
+	size     int
+	attempts int
+	done     chan struct{}
+}
+
+// sendToDeadLetter routes the items at the given indices through q.deadLetter, if set, then
+// resolves their callbacks with the original flush error.
+func (q *BatchQueue) sendToDeadLetter(indices []int, items []interface{}, cbs []Callback, seqs []uint64, dones []chan struct{}, err error) {
+	if q.deadLetter != nil {
+		dropped := make([]interface{}, len(indices))
+		for i, idx := range indices {
+			dropped[i] = items[idx]
+		}
+		q.deadLetter(dropped)
+	}
+
+	for _, idx := range indices {
+		q.ack(seqs[idx : idx+1])
+		cbs[idx] <- err
+		close(cbs[idx])
+		if dones[idx] != nil {
+			close(dones[idx])
+		}
+	}
+}
+
+// requeue puts retried items back at the head of the queue, in their original relative order, so
+// they are the next items included in a flush.
+func (q *BatchQueue) requeue(entries []retryEntry) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	items := make([]interface{}, len(entries))
+	cbs := make([]Callback, len(entries))
+	ctxs := make([]context.Context, len(entries))
+	seqs := make([]uint64, len(entries))
+	sizes := make([]int, len(entries))
+	attempts := make([]int, len(entries))
+	dones := make([]chan struct{}, len(entries))
+	for i, e := range entries {
+		items[i] = e.item
+		cbs[i] = e.cb
+		ctxs[i] = e.ctx
+		seqs[i] = e.seq
+		sizes[i] = e.size
+		attempts[i] = e.attempts
+		dones[i] = e.done
+	}
+
+	q.items = append(items, q.items...)
+	q.cbs = append(cbs, q.cbs...)
+	q.ctxs = append(ctxs, q.ctxs...)
+	q.seqs = append(seqs, q.seqs...)
+	q.itemBytes = append(sizes, q.itemBytes...)
+	q.attempts = append(attempts, q.attempts...)
+	q.done = append(dones, q.done...)
+	for _, s := range sizes {
+		q.byteTotal += s
+	}
+	q.metrics.SetQueueDepth(len(q.items))
+	if !q.waiting {
+		q.waiting = true
+		q.setFlushTimeout()
+	}
+	q.cond.Broadcast()
+}
+
+// itemSet is a best-effort multiset used to correlate the items an ErrorHandler returns back to
+// their original callbacks. It compares with reflect.DeepEqual rather than ==, since == panics on
+// uncomparable item types (maps, slices, funcs) that are otherwise valid interface{} items.
+type itemSet struct {
+	remaining []interface{}
+}
+
+func newItemSet(items []interface{}) *itemSet {
+	return &itemSet{remaining: items}
+}
+
+// take removes one occurrence of item, if present, and reports whether it found one.
+func (s *itemSet) take(item interface{}) bool {
+	for i, candidate := range s.remaining {
+		if reflect.DeepEqual(candidate, item) {
+			s.remaining = append(s.remaining[:i], s.remaining[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package bbq
+
+import "context"
+
+// FlushOf handles the contents of a BatchQueueOf and optionally returns an error
+type FlushOf[T any] func([]T) error
+
+// BatchQueueOf is a generics-based counterpart to BatchQueue. It wraps a BatchQueue so that
+// Flush receives a typed []T instead of []interface{}, sparing callers the type assertion on
+// every element.
+type BatchQueueOf[T any] struct {
+	inner *BatchQueue
+}
+
+// NewBatchQueueOf returns a typed queue with the same flush/backpressure/durability behavior as
+// NewBatchQueue.
+func NewBatchQueueOf[T any](flush FlushOf[T], opts BatchQueueOptions) *BatchQueueOf[T] {
+	untyped := func(items []interface{}) error {
+		typed := make([]T, len(items))
+		for i, item := range items {
+			typed[i] = item.(T)
+		}
+		return flush(typed)
+	}
+	return &BatchQueueOf[T]{inner: NewBatchQueue(untyped, opts)}
+}
+
+// Enqueue puts an item on the batch queue
+func (q *BatchQueueOf[T]) Enqueue(item T) Callback {
+	return q.inner.Enqueue(item)
+}
+
+// EnqueueCtx puts an item on the batch queue with an attached context. See BatchQueue.EnqueueCtx.
+func (q *BatchQueueOf[T]) EnqueueCtx(ctx context.Context, item T) Callback {
+	return q.inner.EnqueueCtx(ctx, item)
+}
+
+// TryEnqueue behaves like Enqueue, but never waits for room in the queue. See BatchQueue.TryEnqueue.
+func (q *BatchQueueOf[T]) TryEnqueue(item T) (Callback, error) {
+	return q.inner.TryEnqueue(item)
+}
+
+// FlushNow hands the current batch off to a flush worker. See BatchQueue.FlushNow.
+func (q *BatchQueueOf[T]) FlushNow() {
+	q.inner.FlushNow()
+}
+
+// Drain waits for all outstanding flush workers to finish, up to ctx's deadline.
+func (q *BatchQueueOf[T]) Drain(ctx context.Context) error {
+	return q.inner.Drain(ctx)
+}
+
+// Close flushes any remaining items and waits for all outstanding flush workers to finish, up to
+// ctx's deadline.
+func (q *BatchQueueOf[T]) Close(ctx context.Context) error {
+	return q.inner.Close(ctx)
+}
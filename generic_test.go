@@ -0,0 +1,29 @@
+package bbq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBatchQueueOfRoundtrip(t *testing.T) {
+	var out TestItem
+	flush := func(ms []TestItem) error {
+		for _, m := range ms {
+			out = m
+		}
+		return nil
+	}
+
+	q := NewBatchQueueOf(flush, BatchQueueOptions{FlushTime: time.Second, FlushCount: 3})
+	k1 := "k1"
+	k2 := "k2"
+	q.Enqueue(TestItem{k1})
+	q.Enqueue(TestItem{k2})
+	q.FlushNow()
+	q.Drain(context.Background())
+	actual := out.key
+	if actual != k2 {
+		t.Errorf("Should be able to roundtrip key, got %v", actual)
+	}
+}
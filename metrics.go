@@ -0,0 +1,102 @@
+package bbq
+
+import (
+	"expvar"
+	"time"
+)
+
+// Metrics receives counters describing a BatchQueue's runtime behavior. Implement this to wire
+// bbq into a metrics system other than expvar; NewExpvarMetrics provides the default.
+type Metrics interface {
+	IncEnqueued(n int)
+	IncFlushed(n int)
+	IncFlushCount()
+	IncFlushErrors()
+	IncTimeoutFlushes()
+	// ObserveFlushLatency reports a single flush's duration. It's named Observe for parity with
+	// histogram-style metrics APIs, but implementations are free to do whatever fits their backend;
+	// ExpvarMetrics just accumulates a running total, since expvar has no histogram type.
+	ObserveFlushLatency(d time.Duration)
+	SetQueueDepth(n int)
+}
+
+// FlushTrigger identifies what caused a flush to happen.
+type FlushTrigger string
+
+const (
+	// TriggerCount means the flush was caused by the batch reaching FlushCount or FlushBytes.
+	TriggerCount FlushTrigger = "count"
+	// TriggerTime means the flush was caused by FlushTime elapsing.
+	TriggerTime FlushTrigger = "time"
+	// TriggerManual means the flush was caused by an explicit FlushNow call.
+	TriggerManual FlushTrigger = "manual"
+	// TriggerShutdown means the flush was caused by Close.
+	TriggerShutdown FlushTrigger = "shutdown"
+)
+
+// FlushStats describes the outcome of a single flush, passed to BatchQueueOptions.OnFlush.
+type FlushStats struct {
+	ItemCount int
+	Duration  time.Duration
+	Err       error
+	Trigger   FlushTrigger
+}
+
+// noopMetrics is the default Metrics implementation, used when neither Metrics nor MetricsName is
+// set, so the rest of the queue never has to check for a nil Metrics.
+type noopMetrics struct{}
+
+func (noopMetrics) IncEnqueued(int)                   {}
+func (noopMetrics) IncFlushed(int)                    {}
+func (noopMetrics) IncFlushCount()                    {}
+func (noopMetrics) IncFlushErrors()                   {}
+func (noopMetrics) IncTimeoutFlushes()                {}
+func (noopMetrics) ObserveFlushLatency(time.Duration) {}
+func (noopMetrics) SetQueueDepth(int)                 {}
+
+// ExpvarMetrics is the default Metrics implementation, backed by an expvar.Map registered under a
+// configurable name. The map's keys are: enqueued, flushed, flush_count, flush_errors,
+// timeout_flushes, flush_latency_ms_total, queue_depth.
+type ExpvarMetrics struct {
+	m *expvar.Map
+}
+
+// NewExpvarMetrics returns an ExpvarMetrics publishing under name. If an expvar.Map is already
+// published under that name (e.g. another BatchQueue sharing it), its counters are reused instead
+// of registering a second map, since expvar panics on duplicate names.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	if existing, ok := expvar.Get(name).(*expvar.Map); ok {
+		return &ExpvarMetrics{m: existing}
+	}
+	return &ExpvarMetrics{m: expvar.NewMap(name)}
+}
+
+func (e *ExpvarMetrics) IncEnqueued(n int) {
+	e.m.Add("enqueued", int64(n))
+}
+
+func (e *ExpvarMetrics) IncFlushed(n int) {
+	e.m.Add("flushed", int64(n))
+}
+
+func (e *ExpvarMetrics) IncFlushCount() {
+	e.m.Add("flush_count", 1)
+}
+
+func (e *ExpvarMetrics) IncFlushErrors() {
+	e.m.Add("flush_errors", 1)
+}
+
+func (e *ExpvarMetrics) IncTimeoutFlushes() {
+	e.m.Add("timeout_flushes", 1)
+}
+
+func (e *ExpvarMetrics) ObserveFlushLatency(d time.Duration) {
+	e.m.Add("flush_latency_ms_total", d.Milliseconds())
+}
+
+func (e *ExpvarMetrics) SetQueueDepth(n int) {
+	depth := new(expvar.Int)
+	depth.Set(int64(n))
+	e.m.Set("queue_depth", depth)
+}
@@ -0,0 +1,138 @@
+package bbq
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Entry is an item recovered from Storage on startup: a sequence number plus its marshaled form.
+type Entry struct {
+	Seq  uint64
+	Data []byte
+}
+
+// Storage lets a BatchQueue persist enqueued items so they survive a process restart. Items are
+// appended before their Callback resolves, and acked once the batch containing them has been
+// successfully flushed, or once they are dropped, canceled via their context, or resolved with an
+// error by the ErrorHandler path. Items from a failed flush with no ErrorHandler set are not acked.
+type Storage interface {
+	// Append persists data and returns the sequence number it was stored under. Sequence numbers
+	// must be monotonically increasing.
+	Append(data []byte) (seq uint64, err error)
+
+	// LoadPending returns all entries that were appended but never acked, in append order.
+	LoadPending() ([]Entry, error)
+
+	// Ack marks the entry at seq, and everything appended before it, as flushed.
+	Ack(seq uint64) error
+}
+
+// wireStorage replays any unacked entries from opts.Storage into q, skipping entries that
+// Unmarshal rejects, and installs the marshal hooks on q for use going forward. Callers must supply both Marshal and Unmarshal when setting Storage, since
+// the queue otherwise has no way to turn an interface{} item into bytes; wireStorage panics if
+// either is missing, and panics if opts.Storage.LoadPending itself fails, since NewBatchQueue has
+// no queue yet to report that error through.
+func (q *BatchQueue) wireStorage(opts BatchQueueOptions) {
+	if opts.Storage == nil {
+		return
+	}
+	if opts.Marshal == nil || opts.Unmarshal == nil {
+		panic("bbq: BatchQueueOptions.Storage requires both Marshal and Unmarshal")
+	}
+
+	q.storage = opts.Storage
+	q.marshal = opts.Marshal
+	q.unmarshal = opts.Unmarshal
+
+	pending, err := opts.Storage.LoadPending()
+	if err != nil {
+		panic(fmt.Sprintf("bbq: loading pending entries: %v", err))
+	}
+
+	// ack's contiguous-prefix tracking assumes q.ackLedger is ascending by seq. LoadPending's
+	// contract says append order, which should already be ascending, but sort defensively rather
+	// than trusting every Storage implementation to honor that.
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Seq < pending[j].Seq })
+
+	for _, entry := range pending {
+		item, err := opts.Unmarshal(entry.Data)
+		if err != nil {
+			continue
+		}
+		var itemBytes int
+		if q.flushBytes > 0 && q.sizer != nil {
+			itemBytes = q.sizer(item)
+		}
+		cb := make(chan error, 1)
+		q.items = append(q.items, item)
+		q.cbs = append(q.cbs, cb)
+		q.ctxs = append(q.ctxs, nil)
+		q.seqs = append(q.seqs, entry.Seq)
+		q.itemBytes = append(q.itemBytes, itemBytes)
+		q.attempts = append(q.attempts, 0)
+		q.done = append(q.done, nil)
+		q.byteTotal += itemBytes
+		q.registerSeq(entry.Seq)
+	}
+}
+
+// persist appends item to q.storage, if configured, and returns its sequence number. Returns
+// (0, nil) when no Storage is configured.
+func (q *BatchQueue) persist(item interface{}) (uint64, error) {
+	if q.storage == nil {
+		return 0, nil
+	}
+	data, err := q.marshal(item)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := q.storage.Append(data)
+	if err != nil {
+		return 0, err
+	}
+	q.registerSeq(seq)
+	return seq, nil
+}
+
+// registerSeq adds seq to q.ackLedger, the ascending record of every seq the queue is tracking
+// acks for. Storage.Ack is cumulative, so ack must only call it with a seq once everything at or
+// below that seq is acked; the ledger is what lets ack detect that.
+func (q *BatchQueue) registerSeq(seq uint64) {
+	q.ackMut.Lock()
+	q.ackLedger = append(q.ackLedger, seq)
+	q.ackMut.Unlock()
+}
+
+// ack records seqs as flushed and, since q.storage.Ack(seq) acks everything up to and including
+// seq, only calls it once the contiguous prefix of q.ackLedger has been acked. Without this, an
+// out-of-order completion (a retried lower seq outliving an already-acked higher sibling, or two
+// concurrent flushes acking out of seq order) would let a cumulative ack truncate still-pending
+// entries from Storage. A no-op when no Storage is configured.
+func (q *BatchQueue) ack(seqs []uint64) {
+	if q.storage == nil || len(seqs) == 0 {
+		return
+	}
+
+	q.ackMut.Lock()
+	defer q.ackMut.Unlock()
+
+	if q.ackedSeqs == nil {
+		q.ackedSeqs = make(map[uint64]bool, len(seqs))
+	}
+	for _, seq := range seqs {
+		q.ackedSeqs[seq] = true
+	}
+
+	var advanced uint64
+	n := 0
+	for n < len(q.ackLedger) && q.ackedSeqs[q.ackLedger[n]] {
+		advanced = q.ackLedger[n]
+		delete(q.ackedSeqs, q.ackLedger[n])
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	q.ackLedger = q.ackLedger[n:]
+	q.storage.Ack(advanced)
+}